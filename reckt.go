@@ -1,14 +1,31 @@
-// reckt analyses Go programs for explicit panics which may reach a root of the callgraph.
+// reckt analyses Go programs for panics, explicit or implicit, which may reach a root of the callgraph.
 //
-// Usage: reckt [-tests] pkg
+// Usage: reckt [-tests] [-lib] [-algo=pointer|cha|rta|static] [-format=text|json] [-pos=file:line:col [-transitive]] pkg
+//
+// The implicit-panic check for indexing is deliberately naive: it only
+// proves an index safe when it's a constant index into a constant-length
+// array, so even idiomatic, provably-safe code like "for i := range s {
+// s[i] = ... }" is reported as a potential "index out of range". See
+// indexProvedSafe.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"go/constant"
+	"go/token"
+	"go/types"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/DanielMorsing/reckt/serial"
+	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/callgraph/cha"
+	"golang.org/x/tools/go/callgraph/rta"
+	"golang.org/x/tools/go/callgraph/static"
 	"golang.org/x/tools/go/loader"
 	"golang.org/x/tools/go/pointer"
 	"golang.org/x/tools/go/ssa"
@@ -16,27 +33,58 @@ import (
 )
 
 var tests = flag.Bool("tests", false, "include tests in analysis")
+var algo = flag.String("algo", "pointer", "callgraph construction algorithm: pointer, cha, rta, static")
+var format = flag.String("format", "text", "output format: text, json")
+var posFlag = flag.String("pos", "", "query position (file:line:col or file:#offset); restrict analysis to its enclosing function")
+var transitive = flag.Bool("transitive", false, "with -pos, also report panics in functions called from the enclosing function")
+var lib = flag.Bool("lib", false, "analyze a library: treat every exported function/method of the initial packages as a callgraph root, instead of requiring a main package (needs -algo=cha, rta or static)")
 
 func main() {
 	flag.Parse()
 
-	prog, err := loadProgram(flag.Args(), *tests)
+	iprog, prog, err := loadProgram(flag.Args(), *tests)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "rect: %s", err)
 		os.Exit(1)
 	}
 
 	panics := findPanics(prog)
+	panics = append(panics, findImplicitPanics(prog)...)
 
-	cg, err := doCallgraph(prog, *tests)
+	cg, err := doCallgraph(prog, *tests, *lib, *algo, initialPackages(iprog, prog))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "rect: %s", err)
 		os.Exit(1)
 	}
+
+	if *posFlag != "" {
+		scope, err := enclosingFunction(iprog, prog, *posFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rect: %s", err)
+			os.Exit(1)
+		}
+		panics = inScope(panics, scope, cg, *transitive)
+	}
+
+	switch *format {
+	case "text":
+		printText(prog, cg, panics)
+	case "json":
+		if err := printJSON(prog, cg, panics); err != nil {
+			fmt.Fprintf(os.Stderr, "rect: %s", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "rect: unknown -format %q: want text or json\n", *format)
+		os.Exit(1)
+	}
+}
+
+func printText(prog *ssa.Program, cg *callgraph.Graph, panics []panicSource) {
 	for _, p := range panics {
 		path := pathToRoot(p, cg)
 		if len(path) != 0 {
-			fmt.Println("Panic at", prog.Fset.Position(p.Pos()), "reaches root")
+			fmt.Printf("Panic (%s) at %s reaches root\n", p.Kind(), prog.Fset.Position(p.Pos()))
 			for _, pth := range path {
 				if pth.Site != nil {
 					fmt.Println("\t", prog.Fset.Position(pth.Pos()), pth.Site.String())
@@ -48,6 +96,65 @@ func main() {
 	}
 }
 
+// printJSON emits one serial.Result object per line for each panic that
+// reaches a root, in the schema documented by the reckt/serial package.
+func printJSON(prog *ssa.Program, cg *callgraph.Graph, panics []panicSource) error {
+	enc := json.NewEncoder(os.Stdout)
+	for _, p := range panics {
+		path := pathToRoot(p, cg)
+		if len(path) == 0 {
+			continue
+		}
+		res := &serial.Result{
+			Panic: &serial.Panic{
+				Pos:  prog.Fset.Position(p.Pos()).String(),
+				Kind: p.Kind(),
+				Func: p.Parent().String(),
+			},
+			Root: rootName(cg.Root),
+		}
+		for i := len(path) - 1; i >= 0; i-- {
+			e := path[i]
+			edge := serial.CallEdge{
+				Callee: rootName(e.Callee),
+				Caller: rootName(e.Caller),
+			}
+			if e.Site != nil {
+				edge.Pos = prog.Fset.Position(e.Pos()).String()
+				edge.Site = siteKind(e.Site)
+			}
+			res.Path = append(res.Path, edge)
+		}
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rootName names the callgraph root for JSON output. Both the pointer
+// analysis's runtime-generated root and reckt's own synthetic one
+// (see addRoot) have no associated *ssa.Function.
+func rootName(root *callgraph.Node) string {
+	if root == nil || root.Func == nil {
+		return "<root>"
+	}
+	return root.Func.String()
+}
+
+// siteKind classifies a call site the way guru's serial package does:
+// as an ordinary call, a "go" statement, or a deferred call.
+func siteKind(site ssa.CallInstruction) string {
+	switch site.(type) {
+	case *ssa.Go:
+		return "go"
+	case *ssa.Defer:
+		return "defer"
+	default:
+		return "call"
+	}
+}
+
 // It would seem that we could check each node
 // see if it has a recover defer, remove it from
 // the callgraph and then just run callgraph.PathSearch
@@ -60,8 +167,7 @@ func main() {
 // So we have to do this instead. Start from the panic and
 // path search back to the root or to a go call which doesn't go
 // through a node with a defer in it.
-//
-func pathToRoot(p *ssa.Panic, cg *callgraph.Graph) []*callgraph.Edge {
+func pathToRoot(p panicSource, cg *callgraph.Graph) []*callgraph.Edge {
 	stack := make([]*callgraph.Edge, 0, 32)
 	seen := make(map[*callgraph.Node]bool)
 	var search func(n *callgraph.Node) []*callgraph.Edge
@@ -88,6 +194,9 @@ func pathToRoot(p *ssa.Panic, cg *callgraph.Graph) []*callgraph.Edge {
 	return search(panicfunc)
 }
 
+// end decides whether n ends the backward search from a panic: either
+// because it's a root (isend), or because a defer on it only dispatches
+// to functions that recover (isdeadend).
 func end(root, n *callgraph.Node) (isend bool, isdeadend bool) {
 	// we need to figure out if this is a root or dead end
 	// Does this function defer a call?
@@ -113,9 +222,25 @@ func end(root, n *callgraph.Node) (isend bool, isdeadend bool) {
 	if n == root {
 		return true, false
 	}
+	// An edge whose Site is an *ssa.Go starts a new goroutine, which is
+	// effectively a root for our purposes: nothing further up the call
+	// stack can recover a panic that happens after the "go" statement
+	// returns. We can only trust that the edge actually reaches n,
+	// though, when the call's callee was resolved statically:
+	// cha/rta/static conservatively link a *ssa.Go edge to every
+	// function in the program matching the called signature whenever
+	// they can't resolve the callee statically, so an edge that's still
+	// dynamic at this point may be a phantom connecting n to an
+	// unrelated "go f()" elsewhere in the program. Treating that as a
+	// root would report the panic along a path that may not exist, so
+	// only a statically resolved *ssa.Go edge counts as a root surrogate
+	// here. A dynamic *ssa.Go edge is searched past like an ordinary
+	// call edge, so a recovering defer in the function holding the "go"
+	// statement ends the search there, although that defer cannot
+	// recover a panic in the new goroutine.
 	for _, in := range n.In {
-		_, ok := in.Site.(*ssa.Go)
-		if ok {
+		g, ok := in.Site.(*ssa.Go)
+		if ok && g.Call.StaticCallee() != nil {
 			return true, false
 		}
 	}
@@ -133,13 +258,23 @@ func allrecovers(o []*callgraph.Node) bool {
 	return true
 }
 
-// control flow can make it so that recover isn't called
-// or we can have multiple recovers in a function, where one
-// is a no-op
+// hasRecover reports whether f unconditionally recovers: every path
+// from f's entry block to every *ssa.Return must pass through a call
+// to the recover() builtin, and that call must not be followed by a
+// re-panic. Someone did write code like that, so here we are.
 //
-// anyone who writes code like that wouldn't use this tool
-// because they're already far gone. Prove me wrong!
+// We use the dominator tree instead of a textual scan: a block b
+// "recovers" a return r iff b dominates r, i.e. every path from entry
+// to r passes through b. f.DomPreorder() forces the dominator tree to
+// be computed; BasicBlock.Dominates then tells us whether some
+// recovering block sits on every path to a given return.
 func hasRecover(f *ssa.Function) bool {
+	if f == nil || len(f.Blocks) == 0 {
+		return false
+	}
+	f.DomPreorder()
+
+	var recovers []*ssa.BasicBlock
 	for _, b := range f.Blocks {
 		for _, i := range b.Instrs {
 			c, ok := i.(*ssa.Call)
@@ -147,28 +282,202 @@ func hasRecover(f *ssa.Function) bool {
 				continue
 			}
 			built, ok := c.Call.Value.(*ssa.Builtin)
-			if !ok {
+			if !ok || built.Name() != "recover" {
 				continue
 			}
-			if built.Name() == "recover" {
-				return true
+			if repanics(b, i) {
+				fmt.Fprintf(os.Stderr, "reckt: warning: %s: recover() may be followed by a re-panic on some path; treating the defer as non-recovering\n", f.Prog.Fset.Position(i.Pos()))
+				continue
 			}
+			recovers = append(recovers, b)
+		}
+	}
+	if len(recovers) == 0 {
+		return false
+	}
+
+	for _, b := range f.Blocks {
+		if len(b.Instrs) == 0 {
+			continue
+		}
+		if _, ok := b.Instrs[len(b.Instrs)-1].(*ssa.Return); !ok {
+			continue
+		}
+		if !dominatedByAny(b, recovers) {
+			return false
+		}
+	}
+	return true
+}
+
+// dominatedByAny reports whether any of doms is on every path from
+// block's function entry to block. Dominates is a method, not a field
+// to walk by hand - there's no public Idom field on *ssa.BasicBlock to
+// chase up the tree ourselves, so this must go through it.
+func dominatedByAny(block *ssa.BasicBlock, doms []*ssa.BasicBlock) bool {
+	for _, d := range doms {
+		if d.Dominates(block) {
+			return true
 		}
 	}
 	return false
 }
 
+// repanics reports whether a re-panic is reachable from recoverCall:
+// either later in the same block, or in any block reachable from it.
+// This catches the common "conditional recover" idiom -
+//
+//	if r := recover(); r != nil && isMyErr(r) {
+//		...
+//	} else {
+//		panic(r)
+//	}
+//
+// - where recover() is always called, but some paths re-panic anyway.
+func repanics(b *ssa.BasicBlock, recoverCall ssa.Instruction) bool {
+	afterCall := false
+	for _, i := range b.Instrs {
+		if afterCall && isPanicCall(i) {
+			return true
+		}
+		if i == recoverCall {
+			afterCall = true
+		}
+	}
+	seen := map[*ssa.BasicBlock]bool{b: true}
+	var walk func(*ssa.BasicBlock) bool
+	walk = func(bb *ssa.BasicBlock) bool {
+		for _, succ := range bb.Succs {
+			if seen[succ] {
+				continue
+			}
+			seen[succ] = true
+			for _, i := range succ.Instrs {
+				if isPanicCall(i) {
+					return true
+				}
+			}
+			if walk(succ) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(b)
+}
+
+// isPanicCall reports whether i is an explicit panic, whether via the
+// panic statement (*ssa.Panic) or a call to the panic() builtin.
+func isPanicCall(i ssa.Instruction) bool {
+	if _, ok := i.(*ssa.Panic); ok {
+		return true
+	}
+	c, ok := i.(*ssa.Call)
+	if !ok {
+		return false
+	}
+	built, ok := c.Call.Value.(*ssa.Builtin)
+	return ok && built.Name() == "panic"
+}
+
+// panicSource is something that may cause the goroutine to panic:
+// either an explicit panic() call or an implicit runtime panic such as
+// an out-of-range index. It lets pathToRoot treat both uniformly.
+type panicSource interface {
+	Pos() token.Pos
+	Kind() string
+	Parent() *ssa.Function
+}
+
+// explicitPanic wraps an *ssa.Panic instruction, deferring Pos and
+// Parent to the embedded instruction.
+type explicitPanic struct {
+	*ssa.Panic
+}
+
+func (explicitPanic) Kind() string { return "explicit panic" }
+
 // find all panic instructions in program
 // TODO: handle go panic() and defer panic(). They're handled
 // as builtin calls, but unlikely to show up in real code.
-func findPanics(prog *ssa.Program) []*ssa.Panic {
-	var panics []*ssa.Panic
+func findPanics(prog *ssa.Program) []panicSource {
+	var panics []panicSource
 	for f := range ssautil.AllFunctions(prog) {
 		for _, b := range f.Blocks {
 			for _, i := range b.Instrs {
 				p, ok := i.(*ssa.Panic)
 				if ok {
-					panics = append(panics, p)
+					panics = append(panics, explicitPanic{p})
+				}
+			}
+		}
+	}
+	return panics
+}
+
+// implicitPanic is an instruction that the Go runtime can turn into a
+// panic even though the source doesn't call panic() directly: an
+// out-of-range index, a failed type assertion, a divide by zero, or a
+// nil pointer dereference.
+type implicitPanic struct {
+	instr ssa.Instruction
+	kind  string
+}
+
+func (p implicitPanic) Pos() token.Pos        { return p.instr.Pos() }
+func (p implicitPanic) Kind() string          { return p.kind }
+func (p implicitPanic) Parent() *ssa.Function { return p.instr.Parent() }
+
+// findImplicitPanics walks the program's SSA looking for instructions
+// that can panic at runtime without an explicit panic() call. It does a
+// cheap, intra-instruction constant check to rule out the obviously
+// safe cases (a constant index into a constant-length array, a
+// provably-nonzero divisor, an address-of a local or global) and
+// conservatively flags everything else: a false negative here would
+// silently drop a real escape path, which is worse than a few false
+// positives that a reader can dismiss at a glance.
+func findImplicitPanics(prog *ssa.Program) []panicSource {
+	var panics []panicSource
+	mark := func(instr ssa.Instruction, kind string) {
+		panics = append(panics, implicitPanic{instr, kind})
+	}
+	for f := range ssautil.AllFunctions(prog) {
+		for _, b := range f.Blocks {
+			for _, instr := range b.Instrs {
+				switch i := instr.(type) {
+				case *ssa.Index:
+					if !indexProvedSafe(i.X.Type(), i.Index) {
+						mark(i, "runtime: index out of range")
+					}
+				case *ssa.IndexAddr:
+					if !indexProvedSafe(i.X.Type(), i.Index) {
+						mark(i, "runtime: index out of range")
+					}
+				case *ssa.TypeAssert:
+					if !i.CommaOk {
+						mark(i, "runtime: interface conversion")
+					}
+				case *ssa.BinOp:
+					// QUO is shared by integer and float/complex
+					// division, and only the integer form panics on a
+					// zero divisor; REM has no float/complex form.
+					if i.Op == token.REM || (i.Op == token.QUO && isIntegerType(i.X.Type())) {
+						if !provedNonZero(i.Y) {
+							mark(i, "runtime: integer divide by zero")
+						}
+					}
+				case *ssa.UnOp:
+					if i.Op == token.MUL && !provedNonNil(i.X) {
+						mark(i, "nil dereference")
+					}
+				case *ssa.FieldAddr:
+					if !provedNonNil(i.X) {
+						mark(i, "nil dereference")
+					}
+				case *ssa.Store:
+					if _, ok := i.Addr.(*ssa.FieldAddr); !ok && !provedNonNil(i.Addr) {
+						mark(i, "nil dereference")
+					}
 				}
 			}
 		}
@@ -176,9 +485,191 @@ func findPanics(prog *ssa.Program) []*ssa.Panic {
 	return panics
 }
 
+// indexProvedSafe reports whether idx is obviously in range for a
+// value of type t: a constant index into a constant-length array. A
+// slice's length is only known at runtime, so it can never be proved
+// safe by this cheap a check - including the common and otherwise
+// perfectly safe "for i := range s { s[i] }" pattern, whose index is
+// a loop-carried value, not a constant. Proving that safe needs real
+// dataflow analysis, which this cheap, intra-instruction check
+// deliberately doesn't do; see findImplicitPanics.
+func indexProvedSafe(t types.Type, idx ssa.Value) bool {
+	c, ok := idx.(*ssa.Const)
+	if !ok || c.Value == nil || c.Value.Kind() != constant.Int {
+		return false
+	}
+	n, ok := constant.Int64Val(c.Value)
+	if !ok || n < 0 {
+		return false
+	}
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	arr, ok := t.Underlying().(*types.Array)
+	if !ok {
+		return false
+	}
+	return n < arr.Len()
+}
+
+// isIntegerType reports whether t is an integer type. token.QUO covers
+// integer, float and complex division alike, but only integer division
+// panics on a zero divisor.
+func isIntegerType(t types.Type) bool {
+	basic, ok := t.Underlying().(*types.Basic)
+	return ok && basic.Info()&types.IsInteger != 0
+}
+
+// provedNonZero reports whether v is a constant known not to be zero.
+func provedNonZero(v ssa.Value) bool {
+	c, ok := v.(*ssa.Const)
+	return ok && c.Value != nil && c.Value.Kind() == constant.Int && constant.Sign(c.Value) != 0
+}
+
+// provedNonNil reports whether v is cheaply known to never be nil: the
+// address of a local, a global, or a field/element thereof. Anything
+// else - a parameter, a loaded pointer, a map lookup - is flagged,
+// since proving those safe needs real dataflow analysis, not a local
+// check.
+func provedNonNil(v ssa.Value) bool {
+	switch v.(type) {
+	case *ssa.Alloc, *ssa.Global, *ssa.FieldAddr, *ssa.IndexAddr:
+		return true
+	}
+	return false
+}
+
+// enclosingFunction resolves a -pos query position (guru's
+// "file:line:col" or "file:#offset" syntax) to the *ssa.Function that
+// lexically contains it, mirroring guru's query-position handling.
+func enclosingFunction(iprog *loader.Program, prog *ssa.Program, posFlag string) (*ssa.Function, error) {
+	pos, err := parseQueryPos(iprog.Fset, posFlag)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range iprog.AllPackages {
+		for _, f := range info.Files {
+			if !tokenFileContains(iprog.Fset, f.Pos(), pos) {
+				continue
+			}
+			path, _ := astutil.PathEnclosingInterval(f, pos, pos)
+			if path == nil {
+				continue
+			}
+			fn := ssa.EnclosingFunction(prog.Package(info.Pkg), path)
+			if fn == nil {
+				return nil, fmt.Errorf("-pos %s: no enclosing function (probably a non-func declaration)", posFlag)
+			}
+			return fn, nil
+		}
+	}
+	return nil, fmt.Errorf("-pos %s: position not found in loaded program", posFlag)
+}
+
+// tokenFileContains reports whether the token.File containing filePos
+// also contains pos.
+func tokenFileContains(fset *token.FileSet, filePos, pos token.Pos) bool {
+	f := fset.File(filePos)
+	return f != nil && f == fset.File(pos)
+}
+
+// parseQueryPos parses a string of the form "file:line:col" or
+// "file:#offset", as used by guru's -pos flag, into a token.Pos in fset.
+func parseQueryPos(fset *token.FileSet, posFlag string) (token.Pos, error) {
+	parts := strings.Split(posFlag, ":")
+	if len(parts) < 2 {
+		return token.NoPos, fmt.Errorf("invalid -pos %q: want file:line:col or file:#offset", posFlag)
+	}
+	if strings.HasPrefix(parts[len(parts)-1], "#") {
+		filename := strings.Join(parts[:len(parts)-1], ":")
+		offset, err := strconv.Atoi(parts[len(parts)-1][1:])
+		if err != nil {
+			return token.NoPos, fmt.Errorf("invalid -pos %q: bad offset: %s", posFlag, err)
+		}
+		f := findTokenFile(fset, filename)
+		if f == nil {
+			return token.NoPos, fmt.Errorf("-pos %q: no such file %q in program", posFlag, filename)
+		}
+		return f.Pos(offset), nil
+	}
+	if len(parts) < 3 {
+		return token.NoPos, fmt.Errorf("invalid -pos %q: want file:line:col or file:#offset", posFlag)
+	}
+	col, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return token.NoPos, fmt.Errorf("invalid -pos %q: bad column: %s", posFlag, err)
+	}
+	line, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil {
+		return token.NoPos, fmt.Errorf("invalid -pos %q: bad line: %s", posFlag, err)
+	}
+	filename := strings.Join(parts[:len(parts)-2], ":")
+	f := findTokenFile(fset, filename)
+	if f == nil {
+		return token.NoPos, fmt.Errorf("-pos %q: no such file %q in program", posFlag, filename)
+	}
+	return f.LineStart(line) + token.Pos(col-1), nil
+}
+
+// findTokenFile returns the token.File in fset whose name is, or ends
+// in a path separator followed by, filename.
+func findTokenFile(fset *token.FileSet, filename string) (file *token.File) {
+	fset.Iterate(func(f *token.File) bool {
+		if f.Name() == filename || strings.HasSuffix(f.Name(), "/"+filename) {
+			file = f
+			return false
+		}
+		return true
+	})
+	return file
+}
+
+// inScope filters panics down to those within the -pos query scope:
+// those inside scope itself, and, with transitive set, those inside any
+// function reachable from scope in cg.
+func inScope(panics []panicSource, scope *ssa.Function, cg *callgraph.Graph, transitive bool) []panicSource {
+	var reachable map[*ssa.Function]bool
+	if transitive {
+		reachable = reachableFuncs(cg, scope)
+	}
+	var out []panicSource
+	for _, p := range panics {
+		if p.Parent() == scope || reachable[p.Parent()] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// reachableFuncs returns the set of functions reachable from scope in
+// cg, including scope itself.
+func reachableFuncs(cg *callgraph.Graph, scope *ssa.Function) map[*ssa.Function]bool {
+	reachable := make(map[*ssa.Function]bool)
+	root, ok := cg.Nodes[scope]
+	if !ok {
+		return reachable
+	}
+	seen := make(map[*callgraph.Node]bool)
+	var walk func(n *callgraph.Node)
+	walk = func(n *callgraph.Node) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		if n.Func != nil {
+			reachable[n.Func] = true
+		}
+		for _, e := range n.Out {
+			walk(e.Callee)
+		}
+	}
+	walk(root)
+	return reachable
+}
+
 var Usage = "Usage: reckt [-test] pkg"
 
-func loadProgram(args []string, tests bool) (*ssa.Program, error) {
+func loadProgram(args []string, tests bool) (*loader.Program, *ssa.Program, error) {
 	conf := loader.Config{}
 
 	if len(args) == 0 {
@@ -189,23 +680,56 @@ func loadProgram(args []string, tests bool) (*ssa.Program, error) {
 	// Use the initial packages from the command line.
 	args, err := conf.FromArgs(args, tests)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Load, parse and type-check the whole program.
 	iprog, err := conf.Load()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Create and build SSA-form program representation.
 	prog := ssautil.CreateProgram(iprog, 0)
 	prog.BuildAll()
-	return prog, nil
+	return iprog, prog, nil
 }
 
+// doCallgraph builds a callgraph using the requested algorithm. With
+// lib set, the callgraph is rooted at the exported API of initial
+// instead of at a main package; the pointer algorithm does not support
+// lib and returns an error for it.
 // boilerplate callgraph code stolen off golang.org/x/tools/cmd/callgraph
-func doCallgraph(prog *ssa.Program, tests bool) (*callgraph.Graph, error) {
+func doCallgraph(prog *ssa.Program, tests, lib bool, algo string, initial []*ssa.Package) (*callgraph.Graph, error) {
+	switch algo {
+	case "pointer":
+		if lib {
+			return nil, fmt.Errorf("-lib is not yet supported with -algo=pointer (it needs a synthetic main that address-takes every root); use -algo=cha or -algo=rta instead")
+		}
+		return pointerCallgraph(prog, tests)
+	case "cha":
+		roots, err := rootFunctions(prog, tests, lib, initial)
+		if err != nil {
+			return nil, err
+		}
+		return rootedCallgraph(cha.CallGraph(prog), roots), nil
+	case "rta":
+		return rtaCallgraph(prog, tests, lib, initial)
+	case "static":
+		roots, err := rootFunctions(prog, tests, lib, initial)
+		if err != nil {
+			return nil, err
+		}
+		return rootedCallgraph(static.CallGraph(prog), roots), nil
+	default:
+		return nil, fmt.Errorf("unknown -algo %q: want pointer, cha, rta or static", algo)
+	}
+}
+
+// pointerCallgraph builds a precise, whole-program callgraph using
+// Andersen-style pointer analysis. It's the most expensive algorithm,
+// both in time and memory, and requires a main package.
+func pointerCallgraph(prog *ssa.Program, tests bool) (*callgraph.Graph, error) {
 	main, err := mainPackage(prog, tests)
 	if err != nil {
 		return nil, err
@@ -223,6 +747,119 @@ func doCallgraph(prog *ssa.Program, tests bool) (*callgraph.Graph, error) {
 	return cg, nil
 }
 
+// rtaCallgraph builds a callgraph using Rapid Type Analysis, seeded
+// from the callgraph roots (main.main/main.init, or, with lib set,
+// every exported function/method of initial). RTA is cheaper than
+// pointer analysis but less precise.
+func rtaCallgraph(prog *ssa.Program, tests, lib bool, initial []*ssa.Package) (*callgraph.Graph, error) {
+	roots, err := rootFunctions(prog, tests, lib, initial)
+	if err != nil {
+		return nil, err
+	}
+	cg := rta.Analyze(roots, true).CallGraph
+	addRoot(cg, roots)
+	return cg, nil
+}
+
+// rootedCallgraph gives a whole-program callgraph built by an algorithm
+// that doesn't itself designate an entry point (CHA, static) a
+// synthetic cg.Root with edges to each of roots, so that end can
+// recognize it as a root the same way it does for pointer analysis's
+// runtime-generated one.
+func rootedCallgraph(cg *callgraph.Graph, roots []*ssa.Function) *callgraph.Graph {
+	addRoot(cg, roots)
+	return cg
+}
+
+// rootFunctions returns the callgraph roots to use: with lib set,
+// every exported function and method of initial (library authors have
+// no main, but want to know which panics escape their public API);
+// otherwise main.main and main.init (or their test-synthesized
+// equivalents).
+func rootFunctions(prog *ssa.Program, tests, lib bool, initial []*ssa.Package) ([]*ssa.Function, error) {
+	if lib {
+		roots := libRoots(prog, initial)
+		if len(roots) == 0 {
+			return nil, fmt.Errorf("-lib: no exported functions or methods found in the initial packages")
+		}
+		return roots, nil
+	}
+	main, err := mainPackage(prog, tests)
+	if err != nil {
+		return nil, err
+	}
+	var roots []*ssa.Function
+	for _, name := range []string{"main", "init"} {
+		if fn := main.Func(name); fn != nil {
+			roots = append(roots, fn)
+		}
+	}
+	return roots, nil
+}
+
+// libRoots returns every exported package-level function, and every
+// exported method (by value and by pointer receiver) of every exported
+// named type, declared in pkgs. These stand in for main.main/main.init
+// as the callgraph roots when analyzing a library: each is a potential
+// entry point from a caller's perspective.
+func libRoots(prog *ssa.Program, pkgs []*ssa.Package) []*ssa.Function {
+	var roots []*ssa.Function
+	for _, pkg := range pkgs {
+		for _, mem := range pkg.Members {
+			switch m := mem.(type) {
+			case *ssa.Function:
+				if m.Object() != nil && m.Object().Exported() {
+					roots = append(roots, m)
+				}
+			case *ssa.Type:
+				if !m.Object().Exported() {
+					continue
+				}
+				roots = append(roots, exportedMethods(prog, m.Type())...)
+				roots = append(roots, exportedMethods(prog, types.NewPointer(m.Type()))...)
+			}
+		}
+	}
+	return roots
+}
+
+// exportedMethods returns the exported methods in t's method set.
+func exportedMethods(prog *ssa.Program, t types.Type) []*ssa.Function {
+	var fns []*ssa.Function
+	mset := prog.MethodSets.MethodSet(t)
+	for i := 0; i < mset.Len(); i++ {
+		sel := mset.At(i)
+		if !sel.Obj().Exported() {
+			continue
+		}
+		if fn := prog.MethodValue(sel); fn != nil {
+			fns = append(fns, fn)
+		}
+	}
+	return fns
+}
+
+// addRoot gives cg a synthetic root node with edges to each of roots.
+func addRoot(cg *callgraph.Graph, roots []*ssa.Function) {
+	cg.Root = cg.CreateNode(nil)
+	for _, fn := range roots {
+		callgraph.AddEdge(cg.Root, nil, cg.CreateNode(fn))
+	}
+}
+
+// initialPackages returns the *ssa.Package for each package named on
+// the command line, as opposed to packages pulled in only as
+// dependencies.
+func initialPackages(iprog *loader.Program, prog *ssa.Program) []*ssa.Package {
+	var pkgs []*ssa.Package
+	for _, info := range iprog.InitialPackages() {
+		if pkg := prog.Package(info.Pkg); pkg != nil {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
 // stolen from callgraph tool
 // mainPackage returns the main package to analyze.
 // The resulting package has a main() function.
@@ -0,0 +1,33 @@
+// Package serial defines the schema used by reckt's -format=json output
+// mode.
+//
+// The shape of Result mirrors the caller/callee/site triples returned
+// by guru and oracle's call-path queries, so that editor and CI tooling
+// already written against those tools needs only minimal changes to
+// consume reckt's results.
+package serial
+
+// Panic describes a single instruction that may cause its goroutine to
+// panic.
+type Panic struct {
+	Pos  string `json:"pos"`  // "file:line:col"
+	Kind string `json:"kind"` // e.g. "explicit panic", "nil dereference"
+	Func string `json:"func"` // fully qualified enclosing function
+}
+
+// CallEdge describes one step of a path from a panic back to a
+// callgraph root.
+type CallEdge struct {
+	Pos    string `json:"pos"`    // "file:line:col" of the call
+	Callee string `json:"callee"` // fully qualified callee
+	Caller string `json:"caller"` // fully qualified caller
+	Site   string `json:"site"`   // "call", "go" or "defer"
+}
+
+// Result is a single reachable panic, reported together with the call
+// path from the root that reaches it.
+type Result struct {
+	Panic *Panic     `json:"panic"`
+	Path  []CallEdge `json:"path"`
+	Root  string     `json:"root"`
+}